@@ -4,10 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strings"
 
-	"github.com/domeos/k8s-ipam/pkg/api/k8s.domeos.sohuno.com/v1alpha1"
+	"github.com/domeos/k8s-ipam/pkg/api/ipam.k8s.io/v1alpha1"
 	ipamclient "github.com/domeos/k8s-ipam/pkg/client/clientset/versioned"
+	"github.com/domeos/k8s-ipam/pkg/store"
 	corev1 "k8s.io/api/core/v1"
 	v1beta1 "k8s.io/api/apps/v1beta1"
 	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
@@ -23,14 +23,15 @@ type PodRetriever interface {
 	GetStatefulSet(string, string) (*v1beta1.StatefulSet, error)
 }
 
-type IPPoolManipulator interface {
-	GetIPPool() (*v1alpha1.IPPool, error)
-	UpdateIPPool(*v1alpha1.IPPool) error
-}
-
+// KubernetesAllocatorClient is everything KubernetesAllocator needs: pod/
+// statefulset lookups to pick the right IPPoolSub, plus a Store to read
+// and persist the pool itself. Depending on store.Store rather than a
+// Kubernetes-specific GetIPPool/UpdateIPPool pair means swapping in a
+// different Store backend (e.g. BoltStore) doesn't require touching
+// KubernetesAllocator at all.
 type KubernetesAllocatorClient interface {
 	PodRetriever
-	IPPoolManipulator
+	store.Store
 }
 
 type KubeClient struct {
@@ -89,7 +90,11 @@ func (k *KubeClient) GetIPPool() (*v1alpha1.IPPool, error) {
 	return client.K8sV1alpha1().IPPools().Get(k.IPPoolName, metav1.GetOptions{})
 }
 
-func (k *KubeClient) UpdateIPPool(pool *v1alpha1.IPPool) error {
+// UpdateIPPool fetches the current IPPool, applies mutate to it, and
+// writes the result back. mutate always runs against this fresh fetch, so
+// a caller never has to worry about a stale earlier GetIPPool result being
+// resubmitted on top of someone else's concurrent update.
+func (k *KubeClient) UpdateIPPool(mutate func(*v1alpha1.IPPool) error) error {
 	conf, err := clientcmd.BuildConfigFromFlags("", k.KubeConfig)
 	if err != nil {
 		return fmt.Errorf("unable to load kubeconfig from %s: %v", k.KubeConfig, err)
@@ -100,115 +105,282 @@ func (k *KubeClient) UpdateIPPool(pool *v1alpha1.IPPool) error {
 		return fmt.Errorf("unable to create client: %v", err)
 	}
 
+	pool, err := client.K8sV1alpha1().IPPools().Get(k.IPPoolName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if err := mutate(pool); err != nil {
+		return err
+	}
+
 	_, err = client.K8sV1alpha1().IPPools().Update(pool)
 	return err
 }
 
+// Lock and Unlock are no-ops: the Kubernetes backend relies on
+// resourceVersion optimistic concurrency instead: UpdateIPPool returns the
+// apiserver's conflict error for a conflicting write, which Allocate and
+// Free report as ErrUpdateConflict, rather than blocking on a lock.
+func (k *KubeClient) Lock() error   { return nil }
+func (k *KubeClient) Unlock() error { return nil }
+
+// StoreConfig selects and configures a store.Store backend.
+type StoreConfig struct {
+	Backend    store.Backend
+	IPPoolName string
+
+	// KubeConfig is used when Backend is store.BackendKubernetes.
+	KubeConfig string
+
+	// BoltPath is used when Backend is store.BackendBoltDB.
+	BoltPath string
+}
+
+// NewStore builds the backend named by cfg.Backend as a
+// KubernetesAllocatorClient, ready to use as a KubernetesAllocator's Client.
+// Every backend -- including store.BackendBoltDB -- implements PodRetriever
+// as well as store.Store, so a standalone deployment never needs a
+// Kubernetes apiserver just to look up the pods it's allocating IPs for.
+func NewStore(cfg StoreConfig) (KubernetesAllocatorClient, error) {
+	switch cfg.Backend {
+	case store.BackendKubernetes, "":
+		return &KubeClient{KubeConfig: cfg.KubeConfig, IPPoolName: cfg.IPPoolName}, nil
+	case store.BackendBoltDB:
+		return &store.BoltStore{Path: cfg.BoltPath, IPPoolName: cfg.IPPoolName}, nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", cfg.Backend)
+	}
+}
+
 type KubernetesAllocator struct {
 	Client KubernetesAllocatorClient
 }
 
-func (a *KubernetesAllocator) Allocate(namespace, podName string) (ip net.IPNet, gateway net.IP, err error) {
+// IPLease is a single IP/gateway pair allocated to a pod from one
+// IPPoolSub. A dual-stack pod gets one lease per address family.
+type IPLease struct {
+	IP      net.IPNet
+	Gateway net.IP
+}
+
+// podHostIPs returns every host IP a pod is scheduled on. Dual-stack
+// clusters populate Status.HostIPs with one entry per family; older
+// clusters only ever set Status.HostIP.
+func podHostIPs(pod *corev1.Pod) ([]net.IP, error) {
+	var raw []string
+	for _, hostIP := range pod.Status.HostIPs {
+		raw = append(raw, hostIP.IP)
+	}
+	if len(raw) == 0 && pod.Status.HostIP != "" {
+		raw = append(raw, pod.Status.HostIP)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("Pod HostIP is not exist")
+	}
+
+	ips := make([]net.IP, 0, len(raw))
+	for _, s := range raw {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Pod HostIP is illegal: %v", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (a *KubernetesAllocator) Allocate(namespace, podName, containerID, ifName string) ([]IPLease, error) {
+	pod, err := a.Client.GetPod(namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	if pod == nil {
+		return nil, fmt.Errorf("Pod is not exist")
+	}
+
+	if err := a.Client.Lock(); err != nil {
+		return nil, err
+	}
+	defer a.Client.Unlock()
+
 	p, err := a.Client.GetIPPool()
 	if err != nil {
-		return ip, gateway, err
+		return nil, err
 	}
-	
-	pod, err := a.Client.GetPod(namespace, podName)
-        if err != nil {
-		return ip, gateway, err
-        }
 
-	if pod == nil {
-		return ip, gateway, fmt.Errorf("Pod is not exist")
+	leases, mutated, err := allocateFromPool(p, pod, namespace, podName, containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+	if !mutated {
+		return leases, nil
 	}
 
-	if pod.Status.HostIP == "" {
-		return ip, gateway, fmt.Errorf("Pod HostIP is not exist")
+	// p above may be stale by the time it's persisted, so UpdateIPPool
+	// re-runs allocateFromPool against whatever IPPool it actually fetches
+	// to apply -- on a conflict, that's a freshly-refetched copy, not the
+	// one computed here -- instead of blindly resubmitting p and silently
+	// clobbering a reservation a racing caller just committed.
+	err = a.Client.UpdateIPPool(func(latest *v1alpha1.IPPool) error {
+		var applyErr error
+		leases, _, applyErr = allocateFromPool(latest, pod, namespace, podName, containerID, ifName)
+		return applyErr
+	})
+	if err != nil {
+		if kubeerrors.IsConflict(err) {
+			// update failed due to stale resourceversion
+			return nil, ErrUpdateConflict
+		}
+		return nil, err
 	}
-	hostIP := net.ParseIP(pod.Status.HostIP)
-	if hostIP == nil {
-		return ip, gateway, fmt.Errorf("Pod HostIP is illegal: %v", pod.Status.HostIP)		
+
+	return leases, nil
+}
+
+// allocateFromPool resolves the leases namespace/podName/containerID/ifName
+// should get from p and, for any sub-pool that doesn't already have a
+// matching reservation, reserves a new IP in p. mutated reports whether p
+// was actually changed, so a caller can skip persisting it when every lease
+// was satisfied by an existing reservation.
+func allocateFromPool(p *v1alpha1.IPPool, pod *corev1.Pod, namespace, podName, containerID, ifName string) (leases []IPLease, mutated bool, err error) {
+	requestedSub, requestedIP, pinned, err := requestedIPPoolSub(p, pod)
+	if err != nil {
+		return nil, false, err
 	}
-	
-	ipPoolSub := p.GetIPPoolSub(hostIP)	
-	if ipPoolSub.Range == "NULL" {
-		return ip, gateway, fmt.Errorf("IPPoolSub is null, can't find matched ipPool")
-	}
-	if err := ipPoolSub.Validate(); err != nil {
-		return ip, gateway, fmt.Errorf("IPPoolSub is invalid.  Please check your configuration.  Error was: %v Got Spec: %v", err, ipPoolSub)
-	}
-
-	gateway = ipPoolSub.Gateway
-	ip = net.IPNet{Mask: ipPoolSub.GetMask()}
-
-	// * If an IP is already assigned to a pod with a matching name/namespace tuple, that ip is reassigned (any pod that's named the same will get the same IP when relaunched)
-	if existingIP := p.GetExistingReservation(namespace, podName); existingIP != nil {
-		ip.IP = *existingIP
-		return ip, gateway, nil
-	}
-	// * Otherwise an IP is chosen randomly
-	var allocatedIP *net.IP
-	for allocatedIP == nil {
-		candidateIP := ipPoolSub.RandomIP()
-		if existingPodNS, existingPodName, found := p.GetPodForIP(candidateIP); found {
-			// If the chosen IP is assigned, we check to see if the pod that has claimed it is still running.
-			pod, err := a.Client.GetPod(existingPodNS, existingPodName)
-			if err != nil {
-				return ip, gateway, err
-			}
 
-			// * If the pod is running a new IP is chosen and the process is repeated until an ip is assigned.
-			if pod != nil {
-				continue
-			}
-			
-			// * If the pod is no longer running, the ownerReferences(statefulSet) may be exist.
-			podNames := strings.Split(existingPodName, "-")
-			if podNames[len(podNames) - 2] == "st" {
-				podNameIndex := strings.LastIndex(existingPodName, "-")
-				stName := existingPodName[0:podNameIndex]
-				st, err := a.Client.GetStatefulSet(existingPodNS, stName)
-				if err != nil {
-					return ip, gateway, err
-				}
-				if st == nil {
-					p.FreeDynamicPodReservation(existingPodNS, existingPodName)
-				} else {
-					continue
-				}
-                        } else {
-				p.FreeDynamicPodReservation(existingPodNS, existingPodName)
+	var ipPoolSubs []v1alpha1.IPPoolSub
+	if pinned {
+		// The annotation names a specific IP or pool, so that's the only
+		// sub-pool in play -- we don't also fall back to the host IPs.
+		ipPoolSubs = []v1alpha1.IPPoolSub{requestedSub}
+	} else {
+		hostIPs, err := podHostIPs(pod)
+		if err != nil {
+			return nil, false, err
+		}
+		ipPoolSubs = p.GetIPPoolSubs(hostIPs)
+	}
+	if len(ipPoolSubs) == 0 {
+		return nil, false, fmt.Errorf("IPPoolSub is null, can't find matched ipPool")
+	}
+
+	// A repeat CNI ADD for the same container/interface -- a retry, most
+	// commonly -- must come back with the same IP rather than minting a
+	// new one, so we check this before touching the pool at all.
+	existingByRef := p.GetExistingReservationByRef(namespace, podName, containerID, ifName)
+
+	for _, ipPoolSub := range ipPoolSubs {
+		if err := ipPoolSub.Validate(); err != nil {
+			return nil, false, fmt.Errorf("IPPoolSub is invalid.  Please check your configuration.  Error was: %v Got Spec: %v", err, ipPoolSub)
+		}
+
+		lease := IPLease{Gateway: ipPoolSub.Gateway}
+		lease.IP.Mask = ipPoolSub.GetMask()
+
+		if reused := reservationForSub(existingByRef, ipPoolSub); reused != nil {
+			lease.IP.IP = reused.IP
+			leases = append(leases, lease)
+			continue
+		}
+
+		var allocatedIP net.IP
+		if pinned && requestedIP != nil {
+			// The annotation pinned an exact IP; Reserve below carves it out
+			// of the free-address set, so there's nothing to pop here.
+			allocatedIP = requestedIP
+		} else {
+			// * Otherwise the next free IP is popped from the sub-pool's
+			// free-address set. Reserve/FreeDynamicPodReservation keep that
+			// set in sync with live reservations, so -- unlike the old
+			// random-probe allocator -- there's nothing here to retry against.
+			var ok bool
+			allocatedIP, ok = p.AllocateIP(ipPoolSub)
+			if !ok {
+				return nil, false, fmt.Errorf("no free IPs available in range %v", ipPoolSub.Range)
 			}
 		}
 
-		allocatedIP = &candidateIP
-		break
+		lease.IP.IP = allocatedIP
+
+		p.Reserve(namespace, podName, v1alpha1.IPReservation{
+			IP:          lease.IP.IP,
+			ContainerID: containerID,
+			IfName:      ifName,
+			PodRef:      v1alpha1.PodRef{Namespace: namespace, PodName: podName},
+			Policy:      releasePolicyFor(pod, requestedIP),
+			PoolName:    ipPoolSub.Name,
+		})
+		mutated = true
+		leases = append(leases, lease)
 	}
 
-	ip.IP = *allocatedIP
+	return leases, mutated, nil
+}
 
-	if !ipPoolSub.RangeContains(*allocatedIP) {
-		return ip, gateway, fmt.Errorf("somehow allocated ip not in network. %v", allocatedIP)
+// requestedIPPoolSub resolves the ipam.domeos.sohuno.com/ip annotation, if
+// the pod set one, to the IPPoolSub it names -- either directly by name, or
+// by containing the specific IP requested. ok is false when the pod didn't
+// set the annotation, in which case Allocate falls back to the sub-pools
+// matching the pod's host IPs. requestedIP is non-nil only when a specific
+// IP (rather than a pool name) was requested.
+func requestedIPPoolSub(p *v1alpha1.IPPool, pod *corev1.Pod) (sub v1alpha1.IPPoolSub, requestedIP net.IP, ok bool, err error) {
+	value := pod.Annotations[v1alpha1.IPAnnotation]
+	if value == "" {
+		return v1alpha1.IPPoolSub{}, nil, false, nil
 	}
 
-	p.Reserve(namespace, podName, ip.IP)
+	if ip := net.ParseIP(value); ip != nil {
+		sub = p.GetIPPoolSub(ip)
+		if sub.Range == "NULL" {
+			return sub, nil, false, fmt.Errorf("requested IP %v (from %s annotation) is not in any configured IPPoolSub", ip, v1alpha1.IPAnnotation)
+		}
+		if sub.ReservedRangeContains(ip) {
+			return sub, nil, false, fmt.Errorf("requested IP %v (from %s annotation) is reserved and cannot be allocated", ip, v1alpha1.IPAnnotation)
+		}
+		if ns, name, found := p.GetPodForIP(ip); found && (ns != pod.Namespace || name != pod.Name) {
+			return sub, nil, false, fmt.Errorf("requested IP %v (from %s annotation) is already reserved to %s/%s", ip, v1alpha1.IPAnnotation, ns, name)
+		}
+		return sub, ip, true, nil
+	}
 
-	err = a.Client.UpdateIPPool(p)
-	if err != nil && kubeerrors.IsConflict(err) {
-		// update failed due to stale resourceversion
-		return ip, gateway, ErrUpdateConflict
+	sub, found := p.GetIPPoolSubByName(value)
+	if !found {
+		return sub, nil, false, fmt.Errorf("requested IPPoolSub %q (from %s annotation) does not exist", value, v1alpha1.IPAnnotation)
 	}
+	return sub, nil, true, nil
+}
 
-	return ip, gateway, err
+// releasePolicyFor determines the ReleasePolicy a newly-created reservation
+// should get. A pod requesting one exact IP via annotation has it pinned
+// regardless of owner; a pod that only named a pool (not a specific IP) gets
+// the ordinary StatefulSet/PodDelete treatment below, since naming a pool is
+// just picking where the address comes from, not asking to keep it forever.
+func releasePolicyFor(pod *corev1.Pod, requestedIP net.IP) v1alpha1.ReleasePolicy {
+	if requestedIP != nil {
+		return v1alpha1.ReleasePolicyImmutable
+	}
+	for _, ownerReference := range pod.ObjectMeta.OwnerReferences {
+		if ownerReference.Kind == "StatefulSet" {
+			return v1alpha1.ReleasePolicyNever
+		}
+	}
+	return v1alpha1.ReleasePolicyPodDelete
 }
 
-func (a *KubernetesAllocator) Free(namespace, podName string) error {
-	p, err := a.Client.GetIPPool()
-	if err != nil {
-		return err
+// reservationForSub picks the existing reservation, if any, that belongs to
+// ipPoolSub's range -- i.e. the one matching its address family.
+func reservationForSub(existingReservations []v1alpha1.IPReservation, ipPoolSub v1alpha1.IPPoolSub) *v1alpha1.IPReservation {
+	for _, reservation := range existingReservations {
+		if ipPoolSub.RangeContains(reservation.IP) {
+			reservation := reservation
+			return &reservation
+		}
 	}
+	return nil
+}
 
+func (a *KubernetesAllocator) Free(namespace, podName string) error {
 	pod, err := a.Client.GetPod(namespace, podName)
 	if err != nil {
 		return err
@@ -217,17 +389,38 @@ func (a *KubernetesAllocator) Free(namespace, podName string) error {
 	if pod != nil {
 		if len(pod.ObjectMeta.OwnerReferences) == 0 {
                 	return errors.New("Pod ObjectMeta is invalid")
-        	}       
-        	for _, ownerReference := range pod.ObjectMeta.OwnerReferences {
-                	if ownerReference.Kind == "StatefulSet" {
-                        	return nil
-                	}       
-        	}	
+        	}
+	}
+
+	if err := a.Client.Lock(); err != nil {
+		return err
 	}
+	defer a.Client.Unlock()
 
-	p.FreeDynamicPodReservation(namespace, podName)
+	p, err := a.Client.GetIPPool()
+	if err != nil {
+		return err
+	}
+	if p.Status.DynamicReservations == nil || len(p.Status.DynamicReservations.Reservations(namespace, podName)) == 0 {
+		// Nothing reserved for this pod; no need to touch the pool.
+		return nil
+	}
 
-	err = a.Client.UpdateIPPool(p)
+	// p above may be stale by the time it's persisted, so re-run
+	// FreeDynamicPodReservation against whatever IPPool UpdateIPPool
+	// actually fetches to apply, instead of acting on a possibly-outdated
+	// snapshot.
+	err = a.Client.UpdateIPPool(func(latest *v1alpha1.IPPool) error {
+		// FreeDynamicPodReservation releases only the reservations eligible
+		// under their own ReleasePolicy -- a StatefulSet pod's reservations
+		// get ReleasePolicyNever, and a pod pinned to one exact IP via
+		// annotation gets ReleasePolicyImmutable for that reservation, either
+		// of which keeps it held regardless of why Free was called. A
+		// dual-stack pod with only one family pinned still has its other,
+		// ordinary lease released.
+		latest.FreeDynamicPodReservation(namespace, podName)
+		return nil
+	})
 	if err != nil && kubeerrors.IsConflict(err) {
 		// update failed due to stale resourceversion
 		return ErrUpdateConflict
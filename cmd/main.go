@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+
+	"github.com/domeos/k8s-ipam/pkg/controller"
+	"github.com/domeos/k8s-ipam/pkg/store"
+)
+
+// AllocateArgs and AllocateReply are the net/rpc request/response pair for
+// IPAMService.Allocate.
+type AllocateArgs struct {
+	Namespace   string
+	PodName     string
+	ContainerID string
+	IfName      string
+}
+
+type AllocateReply struct {
+	Leases []IPLease
+}
+
+// FreeArgs is the net/rpc request for IPAMService.Free; it has no reply
+// fields of its own.
+type FreeArgs struct {
+	Namespace string
+	PodName   string
+}
+
+type FreeReply struct{}
+
+// IPAMService exposes a KubernetesAllocator's Allocate/Free over a local
+// socket via net/rpc, so a thin CNI plugin binary -- exec'd once per ADD/DEL
+// by the kubelet -- can ask this long-lived daemon to do the actual
+// allocation instead of each invocation paying to stand up its own
+// clientset and informer caches.
+type IPAMService struct {
+	allocator *KubernetesAllocator
+}
+
+func (s *IPAMService) Allocate(args *AllocateArgs, reply *AllocateReply) error {
+	leases, err := s.allocator.Allocate(args.Namespace, args.PodName, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	reply.Leases = leases
+	return nil
+}
+
+func (s *IPAMService) Free(args *FreeArgs, reply *FreeReply) error {
+	return s.allocator.Free(args.Namespace, args.PodName)
+}
+
+func main() {
+	kubeConfig := flag.String("kubeconfig", "", "path to a kubeconfig; empty runs with the in-cluster config")
+	ipPoolName := flag.String("ippool-name", "default", "name of the IPPool this daemon allocates from")
+	backend := flag.String("backend", string(store.BackendKubernetes), "store backend: kubernetes or boltdb")
+	boltPath := flag.String("bolt-path", "", "BoltDB file path, used when backend is boltdb")
+	socketPath := flag.String("socket", "/var/run/k8s-ipam.sock", "unix socket to listen on for Allocate/Free calls")
+	flag.Parse()
+
+	stopCh := make(chan struct{})
+	client, err := newAllocatorClient(store.Backend(*backend), *kubeConfig, *ipPoolName, *boltPath, stopCh)
+	if err != nil {
+		log.Fatalf("unable to build store backend %q: %v", *backend, err)
+	}
+
+	if err := rpc.Register(&IPAMService{allocator: &KubernetesAllocator{Client: client}}); err != nil {
+		log.Fatalf("unable to register IPAMService: %v", err)
+	}
+
+	os.Remove(*socketPath)
+	listener, err := net.Listen("unix", *socketPath)
+	if err != nil {
+		log.Fatalf("unable to listen on %s: %v", *socketPath, err)
+	}
+	defer listener.Close()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		close(stopCh)
+		listener.Close()
+	}()
+
+	log.Printf("k8s-ipam listening on %s (backend=%s, ippool=%s)", *socketPath, *backend, *ipPoolName)
+	rpc.Accept(listener)
+}
+
+// newAllocatorClient builds the long-lived KubernetesAllocatorClient this
+// daemon serves Allocate/Free out of. The kubernetes backend runs the
+// informer-backed Controller in-process -- watching IPPool/Pod/StatefulSet
+// once and caching them, rather than KubeClient's per-call GET -- since
+// that's the whole point of running as a daemon instead of exec'ing per
+// CNI ADD/DEL. stopCh is closed on shutdown to stop Controller's informers
+// and update worker. Non-Kubernetes backends have no informer cache to
+// run, so they go through the same NewStore used by one-shot callers.
+func newAllocatorClient(backend store.Backend, kubeConfig, ipPoolName, boltPath string, stopCh <-chan struct{}) (KubernetesAllocatorClient, error) {
+	if backend == store.BackendKubernetes || backend == "" {
+		return controller.NewController(kubeConfig, ipPoolName, stopCh)
+	}
+
+	return NewStore(StoreConfig{
+		Backend:    backend,
+		IPPoolName: ipPoolName,
+		KubeConfig: kubeConfig,
+		BoltPath:   boltPath,
+	})
+}
@@ -2,10 +2,10 @@ package v1alpha1
 
 import (
 	"fmt"
-	"math/rand"
 	"math/big"
 	"net"
-	"time"
+	"sort"
+	"strings"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"github.com/apcera/util/iprange"
 )
@@ -39,12 +39,71 @@ type IPPoolSub struct {
         NetmaskBits        int                      `json:"netmaskBits"`
         Gateway            net.IP                   `json:"gateway"`
         ReservedRanges     []string                 `json:"reservedRanges"`
+        IPFamily           IPFamily                 `json:"ipFamily,omitempty"`
+        // Name lets a pod request this specific sub-pool by name via the
+        // ipam.domeos.sohuno.com/ip annotation, instead of falling back to
+        // whichever sub-pool matches its host IP.
+        Name               string                   `json:"name,omitempty"`
 }
 
+// IPAnnotation is the pod annotation that pins allocation to a specific IP
+// (when the value parses as one) or a named IPPoolSub (otherwise), instead
+// of letting the allocator pick based on the pod's host IP.
+const IPAnnotation = "ipam.domeos.sohuno.com/ip"
+
+// ReleasePolicy controls whether Free() actually returns a reservation's IP
+// to the pool, modeled on galaxy's floatingip release semantics.
+type ReleasePolicy string
+
+const (
+	// ReleasePolicyPodDelete releases the IP once the pod holding it is
+	// deleted. This is the default for ordinary dynamic allocations.
+	ReleasePolicyPodDelete ReleasePolicy = "PodDelete"
+	// ReleasePolicyNever keeps the IP reserved for the pod's identity even
+	// after the pod is gone, so a rescheduled replacement with the same
+	// name gets the same IP back. Set automatically for StatefulSet pods.
+	ReleasePolicyNever ReleasePolicy = "Never"
+	// ReleasePolicyImmutable behaves like Never, and additionally marks
+	// the IP as pinned by configuration or a pod annotation rather than
+	// chosen dynamically.
+	ReleasePolicyImmutable ReleasePolicy = "Immutable"
+)
+
 type IPPoolStatus struct {
 	DynamicReservations IPReservationMap
+	// FreeIntervals is the free-address set for each sub-pool, keyed by
+	// the sub-pool's Range. It's a sorted list of disjoint, inclusive
+	// offset ranges -- offsets counted from the sub-pool's range start --
+	// covering every address not yet reserved. Picking an IP takes the
+	// first free interval and returning one finds its place by binary
+	// search, but updating the list copies it, so both are O(n) in the
+	// number of free intervals (not in the number of addresses), rather
+	// than the old approach of probing random candidates against the
+	// reservation map, which degraded badly as a pool filled up.
+	//
+	// Pools persisted before this field existed come back with it unset;
+	// EnsureFreeIntervals rebuilds it from DynamicReservations the first
+	// time such a pool is loaded, so the upgrade doesn't lose state.
+	FreeIntervals map[string][]IPInterval `json:"freeIntervals,omitempty"`
+}
+
+// IPInterval is an inclusive range of offsets, relative to a sub-pool's
+// range start, that are free to allocate. Offsets are arbitrary-precision:
+// a single IPv6 /64 -- the standard IPv6 allocation size -- already holds
+// 2^64 addresses, which overflows an int64.
+type IPInterval struct {
+	Start *big.Int `json:"start"`
+	End   *big.Int `json:"end"`
 }
 
+// IPFamily identifies whether an IPPoolSub hands out IPv4 or IPv6 addresses.
+type IPFamily string
+
+const (
+	IPFamilyIPv4 IPFamily = "IPv4"
+	IPFamilyIPv6 IPFamily = "IPv6"
+)
+
 // GetIPPoolSub returns the IPPoolSub of podIP
 func (p *IPPool) GetIPPoolSub(ip net.IP) IPPoolSub {
 	ipPoolSub := IPPoolSub {Range: "NULL"}
@@ -61,18 +120,70 @@ func (p *IPPool) GetIPPoolSub(ip net.IP) IPPoolSub {
 	return ipPoolSub
 }
 
+// GetIPPoolSubByName returns the sub-pool with the given Name, used to
+// resolve the ipam.domeos.sohuno.com/ip annotation when it names a pool
+// rather than an IP.
+func (p *IPPool) GetIPPoolSubByName(name string) (IPPoolSub, bool) {
+	for _, ipPoolSub := range p.Spec.IPPoolSubs {
+		if ipPoolSub.Name == name {
+			return ipPoolSub, true
+		}
+	}
+	return IPPoolSub{}, false
+}
+
+// Family returns the address family this sub-pool allocates from. If
+// IPFamily isn't set explicitly, it's detected from Range.
+func (s *IPPoolSub) Family() IPFamily {
+	if s.IPFamily != "" {
+		return s.IPFamily
+	}
+	if ipRange := s.IPRange(); ipRange != nil && ipRange.Start.To4() == nil {
+		return IPFamilyIPv6
+	}
+	return IPFamilyIPv4
+}
+
 // GetMask returns the netmask for ips allocated in this range
 func (s *IPPoolSub) GetMask() net.IPMask {
-	return net.CIDRMask(s.NetmaskBits, 32) //ipv4
+	if s.Family() == IPFamilyIPv6 {
+		return net.CIDRMask(s.NetmaskBits, 128)
+	}
+	return net.CIDRMask(s.NetmaskBits, 32)
 }
 
 func (s *IPPoolSub) IPRange() *iprange.IPRange {
-	ipRange, _ := iprange.ParseIPRange(s.Range)
+	ipRange, _ := parseRange(s.Range)
 	return ipRange
 }
 
+// parseRange parses s as a dash-separated IP range ("start-end", the syntax
+// iprange.ParseIPRange itself expects), expanding s to one first if it looks
+// like CIDR notation instead. iprange.ParseIPRange treats a bare "/N" as a
+// mask to validate a single address against rather than a range to expand,
+// so passing CIDR notation straight through would parse "10.1.2.0/24" as
+// the single address 10.1.2.0 instead of the 256 addresses in that /24.
+func parseRange(s string) (*iprange.IPRange, error) {
+	if !strings.Contains(s, "-") {
+		if _, network, err := net.ParseCIDR(s); err == nil {
+			s = fmt.Sprintf("%s-%s", network.IP, lastIP(network))
+		}
+	}
+	return iprange.ParseIPRange(s)
+}
+
+// lastIP returns the highest address in network -- its broadcast address,
+// for IPv4.
+func lastIP(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return ip
+}
+
 // calculate the size of the range
-func (s *IPPoolSub) IPRangeSize() int64 {
+func (s *IPPoolSub) IPRangeSize() *big.Int {
 	ipRange := s.IPRange()
 	startBig := big.NewInt(0)
 	startBig.SetBytes(ipRange.Start)
@@ -81,7 +192,7 @@ func (s *IPPoolSub) IPRangeSize() int64 {
 	sizeBig := endBig.Sub(endBig, startBig)
 
 	// 1 is added to the size because the end IP is inclusive
-	return sizeBig.Int64() + 1
+	return sizeBig.Add(sizeBig, big.NewInt(1))
 }
 
 // RangeContains returns true if ip is within the range allocated from this pool
@@ -89,6 +200,117 @@ func (s *IPPoolSub) RangeContains(ip net.IP) bool {
 	return s.IPRange().Contains(ip)
 }
 
+// familyBytes returns ip in whichever byte length matches the sub-pool's
+// range (4 bytes for v4, 16 for v6), so it lines up with ipRange.Start/End
+// for offset arithmetic.
+func (s *IPPoolSub) familyBytes(ip net.IP) []byte {
+	if s.Family() == IPFamilyIPv6 {
+		return ip.To16()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// offsetOf returns ip's position relative to the sub-pool's range start.
+// ipRange.Start comes back from the underlying iprange library as a 16-byte
+// net.IP regardless of family, so it's run through familyBytes too -- using
+// it raw would mix a 16-byte (IPv4-in-IPv6) start against a 4-byte ipBig for
+// an IPv4 sub-pool and throw the arithmetic off by the mapped-address prefix.
+func (s *IPPoolSub) offsetOf(ip net.IP) *big.Int {
+	ipRange := s.IPRange()
+	startBig := big.NewInt(0).SetBytes(s.familyBytes(ipRange.Start))
+	ipBig := big.NewInt(0).SetBytes(s.familyBytes(ip))
+	return big.NewInt(0).Sub(ipBig, startBig)
+}
+
+// offsetToIP is the inverse of offsetOf.
+func (s *IPPoolSub) offsetToIP(offset *big.Int) net.IP {
+	ipRange := s.IPRange()
+	startBig := big.NewInt(0).SetBytes(s.familyBytes(ipRange.Start))
+	return s.bigIntToIP(startBig.Add(startBig, offset))
+}
+
+// initialFreeIntervals builds the free-address set for a sub-pool from
+// scratch: the whole range, minus its gateway and reserved ranges.
+func (s *IPPoolSub) initialFreeIntervals() []IPInterval {
+	size := s.IPRangeSize()
+	if size.Sign() <= 0 {
+		return nil
+	}
+	free := []IPInterval{{Start: big.NewInt(0), End: new(big.Int).Sub(size, big.NewInt(1))}}
+
+	if s.Gateway != nil {
+		gatewayOffset := s.offsetOf(s.Gateway)
+		free = removeInterval(free, IPInterval{Start: gatewayOffset, End: gatewayOffset})
+	}
+
+	for _, reservedRange := range s.ReservedRanges {
+		reservedIPRange, err := parseRange(reservedRange)
+		if err != nil {
+			continue
+		}
+		free = removeInterval(free, IPInterval{
+			Start: s.offsetOf(reservedIPRange.Start),
+			End:   s.offsetOf(reservedIPRange.End),
+		})
+	}
+
+	return free
+}
+
+// removeInterval subtracts remove from the sorted, disjoint free set,
+// splitting any interval it partially overlaps.
+func removeInterval(free []IPInterval, remove IPInterval) []IPInterval {
+	var result []IPInterval
+	for _, iv := range free {
+		if remove.End.Cmp(iv.Start) < 0 || remove.Start.Cmp(iv.End) > 0 {
+			result = append(result, iv)
+			continue
+		}
+		if remove.Start.Cmp(iv.Start) > 0 {
+			result = append(result, IPInterval{Start: iv.Start, End: new(big.Int).Sub(remove.Start, big.NewInt(1))})
+		}
+		if remove.End.Cmp(iv.End) < 0 {
+			result = append(result, IPInterval{Start: new(big.Int).Add(remove.End, big.NewInt(1)), End: iv.End})
+		}
+	}
+	return result
+}
+
+// insertInterval adds a single offset back to the sorted, disjoint free set,
+// merging it with neighbouring intervals when it's adjacent to them.
+func insertInterval(free []IPInterval, offset *big.Int) []IPInterval {
+	idx := sort.Search(len(free), func(i int) bool { return free[i].Start.Cmp(offset) > 0 })
+
+	one := big.NewInt(1)
+	mergeWithPrev := idx > 0 && new(big.Int).Add(free[idx-1].End, one).Cmp(offset) == 0
+	mergeWithNext := idx < len(free) && new(big.Int).Sub(free[idx].Start, one).Cmp(offset) == 0
+
+	switch {
+	case mergeWithPrev && mergeWithNext:
+		merged := IPInterval{Start: free[idx-1].Start, End: free[idx].End}
+		next := append([]IPInterval{}, free[:idx-1]...)
+		next = append(next, merged)
+		next = append(next, free[idx+1:]...)
+		return next
+	case mergeWithPrev:
+		next := append([]IPInterval{}, free...)
+		next[idx-1] = IPInterval{Start: next[idx-1].Start, End: offset}
+		return next
+	case mergeWithNext:
+		next := append([]IPInterval{}, free...)
+		next[idx] = IPInterval{Start: offset, End: next[idx].End}
+		return next
+	default:
+		next := append([]IPInterval{}, free[:idx]...)
+		next = append(next, IPInterval{Start: offset, End: offset})
+		next = append(next, free[idx:]...)
+		return next
+	}
+}
+
 // ReservedRangeContains return true if ip is reserved in the pool
 func (s *IPPoolSub) ReservedRangeContains(ip net.IP) bool {
 	if s.Gateway.Equal(ip) {
@@ -99,7 +321,7 @@ func (s *IPPoolSub) ReservedRangeContains(ip net.IP) bool {
 		return false
 	}
         for _, reservedRange := range s.ReservedRanges {
-		reservedIpRange, _ := iprange.ParseIPRange(reservedRange)
+		reservedIpRange, _ := parseRange(reservedRange)
 		if reservedIpRange.Contains(ip) {
 			return true
 		}     
@@ -107,63 +329,132 @@ func (s *IPPoolSub) ReservedRangeContains(ip net.IP) bool {
 	return false 
 }
 
-// GetExistingReservation checks if a reservation for this pod exists, if so return the IP
-func (p *IPPool) GetExistingReservation(namespace, podName string) *net.IP {
-	if p.Spec.StaticReservations != nil {
-		if staticIP := p.Spec.StaticReservations.GetExistingReservation(namespace, podName); staticIP != nil {
-			return staticIP
+// GetIPPoolSubs returns, for each host IP passed in, the IPPoolSub whose
+// range contains it, deduplicated by address family. A dual-stack host
+// yields one IPv4 and one IPv6 sub-pool, so callers can hand the pod one
+// lease per family instead of just one.
+func (p *IPPool) GetIPPoolSubs(hostIPs []net.IP) []IPPoolSub {
+	seenFamilies := make(map[IPFamily]bool)
+	var subs []IPPoolSub
+	for _, hostIP := range hostIPs {
+		sub := p.GetIPPoolSub(hostIP)
+		if sub.Range == "NULL" {
+			continue
 		}
+		family := sub.Family()
+		if seenFamilies[family] {
+			continue
+		}
+		seenFamilies[family] = true
+		subs = append(subs, sub)
 	}
+	return subs
+}
 
-	if p.Status.DynamicReservations == nil {
-		return nil
+// EnsureFreeIntervals makes sure every IPPoolSub has a free-address set in
+// Status.FreeIntervals, building one (and subtracting any IPs already held
+// in DynamicReservations) for any sub-pool that doesn't have one yet. That's
+// always true the first time a pool written before this field existed is
+// loaded, which is how upgrades pick up the new allocator without losing
+// track of already-allocated IPs.
+func (p *IPPool) EnsureFreeIntervals() {
+	if p.Status.FreeIntervals == nil {
+		p.Status.FreeIntervals = make(map[string][]IPInterval)
+	}
+
+	for _, sub := range p.Spec.IPPoolSubs {
+		if _, ok := p.Status.FreeIntervals[sub.Range]; ok {
+			continue
+		}
+
+		free := sub.initialFreeIntervals()
+		if p.Status.DynamicReservations != nil {
+			for _, nsMap := range p.Status.DynamicReservations {
+				for _, reservations := range nsMap {
+					for _, reservation := range reservations {
+						if sub.RangeContains(reservation.IP) {
+							offset := sub.offsetOf(reservation.IP)
+							free = removeInterval(free, IPInterval{Start: offset, End: offset})
+						}
+					}
+				}
+			}
+		}
+		p.Status.FreeIntervals[sub.Range] = free
 	}
-	return p.Status.DynamicReservations.GetExistingReservation(namespace, podName)
 }
 
-func (s *IPPoolSub) RandomIP() net.IP {
-	var netIP net.IP
-	ipRange := s.IPRange()
-        startBig := big.NewInt(0)
-        startBig.SetBytes(ipRange.Start)
-        endBig := big.NewInt(0)
-        endBig.SetBytes(ipRange.End)
-        sizeBig := endBig.Sub(endBig, startBig)
-
-        // 1 is added to the size because the end IP is inclusive
-        ipRangeSize := sizeBig.Int64() + 1
-	rand.Seed(time.Now().UnixNano())
-	for netIP == nil {
-		// get a random number within the size to start with
-        	idx := rand.Int63n(ipRangeSize)
-		startBig := big.NewInt(0)
-        	startBig.SetBytes(ipRange.Start)
-        	newBig := big.NewInt(0).Add(startBig, big.NewInt(idx))
-        	ip := s.bigIntToIP(newBig)
-		if !s.ReservedRangeContains(ip) {
-			netIP = ip
-			break
-		}	
-	}
-	return netIP
+// AllocateIP takes the lowest free IP out of sub's free-address set.
+// Shrinking the first interval copies the interval list, so this is O(n) in
+// the number of free intervals. ok is false if the sub-pool has no free
+// addresses left.
+func (p *IPPool) AllocateIP(sub IPPoolSub) (ip net.IP, ok bool) {
+	p.EnsureFreeIntervals()
+
+	free := p.Status.FreeIntervals[sub.Range]
+	if len(free) == 0 {
+		return nil, false
+	}
+
+	offset := free[0].Start
+	if free[0].Start.Cmp(free[0].End) == 0 {
+		free = free[1:]
+	} else {
+		next := append([]IPInterval{}, free...)
+		next[0] = IPInterval{Start: new(big.Int).Add(free[0].Start, big.NewInt(1)), End: free[0].End}
+		free = next
+	}
+	p.Status.FreeIntervals[sub.Range] = free
+
+	return sub.offsetToIP(offset), true
+}
+
+// ReleaseIP returns ip to sub's free-address set.
+func (p *IPPool) ReleaseIP(sub IPPoolSub, ip net.IP) {
+	p.EnsureFreeIntervals()
+	p.Status.FreeIntervals[sub.Range] = insertInterval(p.Status.FreeIntervals[sub.Range], sub.offsetOf(ip))
+}
+
+// GetExistingReservations checks if reservations for this pod exist, if so return the IPs
+func (p *IPPool) GetExistingReservations(namespace, podName string) []net.IP {
+	var ips []net.IP
+	if p.Spec.StaticReservations != nil {
+		ips = append(ips, p.Spec.StaticReservations.GetExistingReservations(namespace, podName)...)
+	}
+
+	if p.Status.DynamicReservations != nil {
+		ips = append(ips, p.Status.DynamicReservations.GetExistingReservations(namespace, podName)...)
+	}
+	return ips
 }
 
 func (s *IPPoolSub) bigIntToIP(newBig *big.Int) net.IP {
+	buf := newBig.Bytes()
+
+	if s.Family() == IPFamilyIPv6 {
+		// Convert it back into a 16 byte slice, populating the tail so
+		// the leading bytes default to zero.
+		ipbytes := make([]byte, 16)
+		position := 16 - len(buf)
+		if position >= 0 {
+			copy(ipbytes[position:], buf)
+		}
+		return net.IP(ipbytes)
+	}
+
 	// Convert it back into a 16 byte slice. net.IP expects a 16 byte
 	// slice, and expects the elements to be not be the leading bytes
 	// but the trailing. So we must create a new slice and populate its
 	// tail.
-	buf := newBig.Bytes()
 	ipbytes := make([]byte, 16)
-	position := 16 - len(buf)
-	ipv6in4 := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+	position := 4 - len(buf)
+	ipv4in6 := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
 	// If the position we need to copy to is less than 0, then this
 	// would cause an index out of range. This will only happen when
-	// we've max'd out 16 bytes, so then we'll just loop around to zero.
+	// we've max'd out 4 bytes, so then we'll just loop around to zero.
 	if position >= 0 {
-		// copy only the last 4 bytes and ensure we set the IPv4 in v6 prefix
-		copy(ipbytes, ipv6in4)
-		copy(ipbytes[12:], buf[len(buf)-4:])
+		copy(ipbytes, ipv4in6)
+		copy(ipbytes[12+position:], buf)
 	}
 
 	return net.IP(ipbytes)
@@ -188,33 +479,63 @@ func (p *IPPool) GetPodForIP(ip net.IP) (namespace, podName string, found bool)
 	return "", "", false
 }
 
-func (p *IPPool) Reserve(namespace, podName string, ip net.IP) {
+// Reserve records reservation in the dynamic reservation map and carves its
+// IP out of the owning sub-pool's free-address set. The latter is a no-op if
+// the IP was already allocated via AllocateIP, and is what makes an
+// explicitly-requested IP (one not obtained through AllocateIP) show up as
+// used too.
+func (p *IPPool) Reserve(namespace, podName string, reservation IPReservation) {
 	if p.Status.DynamicReservations == nil {
 		p.Status.DynamicReservations = NewIPReservationMap()
 	}
-	p.Status.DynamicReservations.Reserve(namespace, podName, ip)
+	p.Status.DynamicReservations.Reserve(namespace, podName, reservation)
+
+	if sub := p.GetIPPoolSub(reservation.IP); sub.Range != "NULL" {
+		p.EnsureFreeIntervals()
+		offset := sub.offsetOf(reservation.IP)
+		p.Status.FreeIntervals[sub.Range] = removeInterval(p.Status.FreeIntervals[sub.Range], IPInterval{Start: offset, End: offset})
+	}
+}
+
+// GetExistingReservationByRef returns the dynamic reservations already made
+// for this container/interface, if any. Static reservations aren't tied to a
+// ContainerID/IfName, so they're not considered here.
+func (p *IPPool) GetExistingReservationByRef(namespace, podName, containerID, ifName string) []IPReservation {
+	if p.Status.DynamicReservations == nil {
+		return nil
+	}
+	return p.Status.DynamicReservations.GetExistingReservationByRef(namespace, podName, containerID, ifName)
 }
 
-// FreeDynamicPodReservation removes any existing dynamic reservations for a given pod
+// FreeDynamicPodReservation releases the dynamic reservations held for a pod
+// that are eligible for release, and returns their IPs to each owning
+// sub-pool's free-address set. A ReleasePolicyNever or ReleasePolicyImmutable
+// reservation keeps its IP regardless of what's asking to free it -- that's
+// the whole point of pinning it -- so e.g. a dual-stack pod with only its
+// IPv6 lease pinned still has its ordinary IPv4 lease released.
 func (p *IPPool) FreeDynamicPodReservation(namespace, podName string) {
 	if p.Status.DynamicReservations == nil {
 		return
 	}
 
-	p.Status.DynamicReservations.FreePodReservation(namespace, podName)
+	for _, ip := range p.Status.DynamicReservations.FreeReleasableReservations(namespace, podName) {
+		if sub := p.GetIPPoolSub(ip); sub.Range != "NULL" {
+			p.ReleaseIP(sub, ip)
+		}
+	}
 }
 
 // Validate returns nil if there are no obvious errors in IP Pool configuration
 func (s *IPPoolSub) Validate() error {
 	// Range is valid
-	_, err := iprange.ParseIPRange(s.Range)
+	_, err := parseRange(s.Range)
 	if err != nil {
 		return fmt.Errorf("IP range is invalid (%v), please check your syntax: %v", s.Range, err)
 	}
 	// ReservedRange is valid
 	if len(s.ReservedRanges) != 0 {
 		for _, reservedRange := range s.ReservedRanges {
-			_, err := iprange.ParseIPRange(reservedRange)
+			_, err := parseRange(reservedRange)
         		if err != nil {
                 		return fmt.Errorf("Reserved IP range is invalid (%v), please check your syntax: %v", reservedRange, err)
         		}
@@ -222,9 +543,13 @@ func (s *IPPoolSub) Validate() error {
 	}
 	
 	// NetmaskBits are valid
-	if s.NetmaskBits <= 0 || s.NetmaskBits >= 32 {
+	maxBits := 32
+	if s.Family() == IPFamilyIPv6 {
+		maxBits = 128
+	}
+	if s.NetmaskBits <= 0 || s.NetmaskBits >= maxBits {
 		return fmt.Errorf("Specified netmask is invalid")
-	}	
+	}
 
 	if s.Gateway == nil  {
 		return fmt.Errorf("Gateway must be set.")
@@ -233,37 +558,96 @@ func (s *IPPoolSub) Validate() error {
 	return nil
 }
 
-type IPReservationMap map[string]map[string]net.IP
+// PodRef identifies the pod a reservation was made for.
+type PodRef struct {
+	Namespace string `json:"namespace"`
+	PodName   string `json:"podName"`
+}
+
+// IPReservation is a single IP held for a pod's network interface. Keying on
+// ContainerID/IfName (rather than just the pod) lets a repeat CNI ADD for the
+// same interface -- a retry, or a second interface on the same pod -- be
+// recognized and handed back the same IP instead of minting a new one.
+type IPReservation struct {
+	IP          net.IP        `json:"ip"`
+	ContainerID string        `json:"containerID"`
+	IfName      string        `json:"ifName"`
+	PodRef      PodRef        `json:"podRef"`
+	// Policy governs whether Free() releases this IP. Defaults to
+	// ReleasePolicyPodDelete if unset.
+	Policy   ReleasePolicy `json:"policy,omitempty"`
+	PoolName string        `json:"poolName,omitempty"`
+}
+
+// IPReservationMap holds the reservations held per pod. A pod may hold more
+// than one reservation at a time -- one per address family for dual-stack
+// pods, or one per interface for multi-interface pods -- so each podName maps
+// to a slice of reservations rather than a single one.
+type IPReservationMap map[string]map[string][]IPReservation
 
 func NewIPReservationMap() IPReservationMap {
-	return make(map[string]map[string]net.IP)
+	return make(map[string]map[string][]IPReservation)
+}
+
+// GetExistingReservations returns the IPs currently reserved for a pod,
+// across all of its containers/interfaces.
+func (m IPReservationMap) GetExistingReservations(namespace, podName string) []net.IP {
+	namespaceMap, nsFound := m[namespace]
+	if !nsFound {
+		return nil
+	}
+	var ips []net.IP
+	for _, reservation := range namespaceMap[podName] {
+		ips = append(ips, reservation.IP)
+	}
+	return ips
+}
+
+// Reservations returns every reservation held for a pod, regardless of
+// which container/interface claimed it.
+func (m IPReservationMap) Reservations(namespace, podName string) []IPReservation {
+	namespaceMap, nsFound := m[namespace]
+	if !nsFound {
+		return nil
+	}
+	return namespaceMap[podName]
 }
 
-func (m IPReservationMap) GetExistingReservation(namespace, podName string) *net.IP {
-	if namespaceMap, nsFound := m[namespace]; nsFound {
-		if podIp, podFound := namespaceMap[podName]; podFound {
-			return &podIp
+// GetExistingReservationByRef returns the reservations already made for this
+// exact container/interface, if any. A dual-stack pod has one entry per
+// address family sharing the same ContainerID/IfName.
+func (m IPReservationMap) GetExistingReservationByRef(namespace, podName, containerID, ifName string) []IPReservation {
+	namespaceMap, nsFound := m[namespace]
+	if !nsFound {
+		return nil
+	}
+	var matches []IPReservation
+	for _, reservation := range namespaceMap[podName] {
+		if reservation.ContainerID == containerID && reservation.IfName == ifName {
+			matches = append(matches, reservation)
 		}
 	}
-	return nil
+	return matches
 }
 
 func (m IPReservationMap) GetPodForIP(ip net.IP) (namespace, podName string, found bool) {
 	for namespace, nsMap := range m {
-		for podName, podIp := range nsMap {
-			if podIp.Equal(ip) {
-				return namespace, podName, true
+		for podName, reservations := range nsMap {
+			for _, reservation := range reservations {
+				if reservation.IP.Equal(ip) {
+					return namespace, podName, true
+				}
 			}
 		}
 	}
 	return "", "", false
 }
 
-func (m IPReservationMap) Reserve(namespace, podName string, ip net.IP) {
+func (m IPReservationMap) Reserve(namespace, podName string, reservation IPReservation) {
 	if _, ok := m[namespace]; !ok {
-		m[namespace] = make(map[string]net.IP, 0)
+		m[namespace] = make(map[string][]IPReservation)
 	}
-	m[namespace][podName] = ip
+	m[namespace][podName] = append(m[namespace][podName], reservation)
 }
 
 func (m IPReservationMap) AlreadyReserved(ip net.IP) bool {
@@ -271,14 +655,39 @@ func (m IPReservationMap) AlreadyReserved(ip net.IP) bool {
 	return found
 }
 
-func (m IPReservationMap) FreePodReservation(namespace, podName string) {
-	if _, nsFound := m[namespace]; nsFound {
-		if _, podFound := m[namespace][podName]; podFound {
-			delete(m[namespace], podName)
-		}
+// FreeReleasableReservations removes and returns the IPs of a pod's
+// reservations that aren't pinned by ReleasePolicyNever or
+// ReleasePolicyImmutable, leaving any pinned reservations in place. A pod
+// left with no reservations at all is removed from the map entirely, same as
+// it was before being reserved.
+func (m IPReservationMap) FreeReleasableReservations(namespace, podName string) []net.IP {
+	namespaceMap, nsFound := m[namespace]
+	if !nsFound {
+		return nil
+	}
+	reservations, podFound := namespaceMap[podName]
+	if !podFound {
+		return nil
+	}
 
-		if len(m[namespace]) == 0 {
-			delete(m, namespace)
+	var freedIPs []net.IP
+	var kept []IPReservation
+	for _, reservation := range reservations {
+		if reservation.Policy == ReleasePolicyNever || reservation.Policy == ReleasePolicyImmutable {
+			kept = append(kept, reservation)
+			continue
 		}
+		freedIPs = append(freedIPs, reservation.IP)
 	}
+
+	if len(kept) == 0 {
+		delete(namespaceMap, podName)
+	} else {
+		namespaceMap[podName] = kept
+	}
+	if len(namespaceMap) == 0 {
+		delete(m, namespace)
+	}
+
+	return freedIPs
 }
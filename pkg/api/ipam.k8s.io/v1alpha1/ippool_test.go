@@ -0,0 +1,157 @@
+package v1alpha1
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+func TestIPRangeSizeIPv6SlashSixtyFour(t *testing.T) {
+	sub := IPPoolSub{Range: "2001:db8::/64", IPFamily: IPFamilyIPv6}
+
+	got := sub.IPRangeSize()
+	want := new(big.Int).Lsh(big.NewInt(1), 64)
+	if got.Cmp(want) != 0 {
+		t.Fatalf("IPRangeSize() = %s, want 2^64 (%s) -- a /64 already overflows int64, which used to come back as 1", got, want)
+	}
+}
+
+func TestIPRangeSizeIPv4SlashTwentyFour(t *testing.T) {
+	sub := IPPoolSub{Range: "10.1.2.0/24", IPFamily: IPFamilyIPv4}
+
+	got := sub.IPRangeSize()
+	if got.Cmp(big.NewInt(256)) != 0 {
+		t.Fatalf("IPRangeSize() = %s, want 256", got)
+	}
+}
+
+func TestOffsetOfAndOffsetToIPRoundTripBeyondInt64(t *testing.T) {
+	sub := IPPoolSub{Range: "2001:db8::/64", IPFamily: IPFamilyIPv6}
+
+	// 2^63 past the range start -- one more than the largest int64, which
+	// is exactly where the int64-based implementation silently wrapped.
+	ip := net.ParseIP("2001:db8::8000:0:0:0")
+	offset := sub.offsetOf(ip)
+
+	want := new(big.Int).Lsh(big.NewInt(1), 63)
+	if offset.Cmp(want) != 0 {
+		t.Fatalf("offsetOf(%v) = %s, want %s", ip, offset, want)
+	}
+	if got := sub.offsetToIP(offset); !got.Equal(ip) {
+		t.Fatalf("offsetToIP(offsetOf(%v)) = %v, want %v", ip, got, ip)
+	}
+}
+
+// TestInitialFreeIntervalsIPv6SlashSixtyFourIsNotASingleAddress guards
+// against the size regression directly: a /64 whose size came back as 1
+// would give a free set covering exactly one address, and an int64-based
+// size (2^64 - 1 wraps to -1, plus one is 0) would give none at all,
+// instead of 2^64 addresses minus the gateway.
+func TestInitialFreeIntervalsIPv6SlashSixtyFourIsNotASingleAddress(t *testing.T) {
+	sub := IPPoolSub{
+		Range:    "2001:db8::/64",
+		IPFamily: IPFamilyIPv6,
+		Gateway:  net.ParseIP("2001:db8::1"),
+	}
+
+	free := sub.initialFreeIntervals()
+
+	total := big.NewInt(0)
+	for _, iv := range free {
+		span := new(big.Int).Sub(iv.End, iv.Start)
+		span.Add(span, big.NewInt(1))
+		total.Add(total, span)
+	}
+
+	want := new(big.Int).Sub(sub.IPRangeSize(), big.NewInt(1)) // minus the gateway
+	if total.Cmp(want) != 0 {
+		t.Fatalf("initialFreeIntervals() covers %s addresses, want %s", total, want)
+	}
+}
+
+func assertIntervalsEqual(t *testing.T, got, want []IPInterval) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d intervals, want %d: got=%v want=%v", len(got), len(want), got, want)
+	}
+	for i := range got {
+		if got[i].Start.Cmp(want[i].Start) != 0 || got[i].End.Cmp(want[i].End) != 0 {
+			t.Fatalf("interval %d = [%s,%s], want [%s,%s]", i, got[i].Start, got[i].End, want[i].Start, want[i].End)
+		}
+	}
+}
+
+func TestRemoveIntervalSplitsOnPartialOverlap(t *testing.T) {
+	free := []IPInterval{{Start: big.NewInt(0), End: big.NewInt(9)}}
+
+	got := removeInterval(free, IPInterval{Start: big.NewInt(3), End: big.NewInt(5)})
+
+	assertIntervalsEqual(t, got, []IPInterval{
+		{Start: big.NewInt(0), End: big.NewInt(2)},
+		{Start: big.NewInt(6), End: big.NewInt(9)},
+	})
+}
+
+func TestRemoveIntervalNoOverlapIsUnchanged(t *testing.T) {
+	free := []IPInterval{{Start: big.NewInt(0), End: big.NewInt(9)}}
+
+	got := removeInterval(free, IPInterval{Start: big.NewInt(20), End: big.NewInt(25)})
+
+	assertIntervalsEqual(t, got, free)
+}
+
+func TestInsertIntervalMergesBothNeighbours(t *testing.T) {
+	free := []IPInterval{
+		{Start: big.NewInt(0), End: big.NewInt(2)},
+		{Start: big.NewInt(4), End: big.NewInt(4)},
+		{Start: big.NewInt(6), End: big.NewInt(9)},
+	}
+
+	got := insertInterval(free, big.NewInt(3))
+	got = insertInterval(got, big.NewInt(5))
+
+	assertIntervalsEqual(t, got, []IPInterval{{Start: big.NewInt(0), End: big.NewInt(9)}})
+}
+
+func TestInsertIntervalWithNoAdjacentNeighbourInsertsNewEntry(t *testing.T) {
+	free := []IPInterval{
+		{Start: big.NewInt(0), End: big.NewInt(2)},
+		{Start: big.NewInt(6), End: big.NewInt(9)},
+	}
+
+	got := insertInterval(free, big.NewInt(4))
+
+	assertIntervalsEqual(t, got, []IPInterval{
+		{Start: big.NewInt(0), End: big.NewInt(2)},
+		{Start: big.NewInt(4), End: big.NewInt(4)},
+		{Start: big.NewInt(6), End: big.NewInt(9)},
+	})
+}
+
+func TestAllocateIPExhaustionThenReleaseIPFreesItUpAgain(t *testing.T) {
+	pool := &IPPool{
+		Spec: IPPoolSpec{
+			IPPoolSubs: []IPPoolSub{{Range: "10.1.2.0/30", IPFamily: IPFamilyIPv4}},
+		},
+	}
+	sub := pool.Spec.IPPoolSubs[0]
+
+	var allocated []net.IP
+	for i := 0; i < 4; i++ {
+		ip, ok := pool.AllocateIP(sub)
+		if !ok {
+			t.Fatalf("AllocateIP() attempt %d: ok = false, want true", i)
+		}
+		allocated = append(allocated, ip)
+	}
+
+	if _, ok := pool.AllocateIP(sub); ok {
+		t.Fatalf("AllocateIP() on an exhausted /30 returned ok = true, want false")
+	}
+
+	pool.ReleaseIP(sub, allocated[1])
+	ip, ok := pool.AllocateIP(sub)
+	if !ok || !ip.Equal(allocated[1]) {
+		t.Fatalf("AllocateIP() after releasing %v = %v, %v, want %v, true", allocated[1], ip, ok, allocated[1])
+	}
+}
@@ -0,0 +1,181 @@
+// Package controller runs long-lived, informer-backed caches for the
+// objects KubernetesAllocator needs (IPPool, Pod, StatefulSet) so repeated
+// allocations don't each pay for a fresh REST config and clientset, and
+// their reads are served from the cache. An IPPool update still GETs the
+// pool from the apiserver before writing it. It also centralizes the retry-on-conflict handling
+// for IPPool updates, since concurrent allocations racing on the same
+// resourceVersion is the common case, not the exception.
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/domeos/k8s-ipam/pkg/api/ipam.k8s.io/v1alpha1"
+	ipamclient "github.com/domeos/k8s-ipam/pkg/client/clientset/versioned"
+	ipaminformers "github.com/domeos/k8s-ipam/pkg/client/informers/externalversions"
+	ipamlisters "github.com/domeos/k8s-ipam/pkg/client/listers/ipam.k8s.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/api/apps/v1beta1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1beta1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const resyncPeriod = 30 * time.Second
+
+// Controller watches IPPool, Pod, and StatefulSet objects and serves them
+// out of an informer cache. It implements the same GetPod/GetStatefulSet
+// methods as KubeClient, plus store.Store, so KubernetesAllocator can use
+// either one as its Client without any other code changes.
+type Controller struct {
+	ipamClient ipamclient.Interface
+	ipPoolName string
+
+	podLister         corelisters.PodLister
+	statefulSetLister appslisters.StatefulSetLister
+	ipPoolLister      ipamlisters.IPPoolLister
+
+	podsSynced         cache.InformerSynced
+	statefulSetsSynced cache.InformerSynced
+	ipPoolsSynced      cache.InformerSynced
+
+	// updateQueue serializes IPPool updates so two allocations racing on
+	// the same pool retry one at a time instead of repeatedly colliding.
+	updateQueue workqueue.RateLimitingInterface
+}
+
+// updateRequest is one caller's mutation, carried through updateQueue so
+// concurrent UpdateIPPool calls are applied one at a time.
+type updateRequest struct {
+	mutate func(*v1alpha1.IPPool) error
+	done   chan error
+}
+
+// NewController builds the clientsets and informer factories from
+// kubeConfig (pass "" to use in-cluster config) and starts them. It blocks
+// until the caches have done their initial sync.
+func NewController(kubeConfig, ipPoolName string, stopCh <-chan struct{}) (*Controller, error) {
+	conf, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig from %s: %v", kubeConfig, err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create kube client: %v", err)
+	}
+
+	ipamClient, err := ipamclient.NewForConfig(conf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create ipam client: %v", err)
+	}
+
+	kubeInformers := informers.NewSharedInformerFactory(kubeClient, resyncPeriod)
+	ipamInformers := ipaminformers.NewSharedInformerFactory(ipamClient, resyncPeriod)
+
+	podInformer := kubeInformers.Core().V1().Pods()
+	statefulSetInformer := kubeInformers.Apps().V1beta1().StatefulSets()
+	ipPoolInformer := ipamInformers.K8sV1alpha1().IPPools()
+
+	c := &Controller{
+		ipamClient:         ipamClient,
+		ipPoolName:         ipPoolName,
+		podLister:          podInformer.Lister(),
+		statefulSetLister:  statefulSetInformer.Lister(),
+		ipPoolLister:       ipPoolInformer.Lister(),
+		podsSynced:         podInformer.Informer().HasSynced,
+		statefulSetsSynced: statefulSetInformer.Informer().HasSynced,
+		ipPoolsSynced:      ipPoolInformer.Informer().HasSynced,
+		updateQueue:        workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	kubeInformers.Start(stopCh)
+	ipamInformers.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, c.podsSynced, c.statefulSetsSynced, c.ipPoolsSynced) {
+		return nil, fmt.Errorf("timed out waiting for informer caches to sync")
+	}
+
+	go c.runUpdateWorker()
+	go func() {
+		<-stopCh
+		c.updateQueue.ShutDown()
+	}()
+
+	return c, nil
+}
+
+// runUpdateWorker applies queued IPPool updates one at a time until
+// updateQueue is shut down.
+func (c *Controller) runUpdateWorker() {
+	for {
+		item, shutdown := c.updateQueue.Get()
+		if shutdown {
+			return
+		}
+
+		req := item.(*updateRequest)
+		req.done <- c.applyUpdateWithRetry(req.mutate)
+		c.updateQueue.Done(item)
+	}
+}
+
+func (c *Controller) GetPod(namespace, podName string) (*corev1.Pod, error) {
+	pod, err := c.podLister.Pods(namespace).Get(podName)
+	if kubeerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return pod, err
+}
+
+func (c *Controller) GetStatefulSet(namespace, stName string) (*v1beta1.StatefulSet, error) {
+	st, err := c.statefulSetLister.StatefulSets(namespace).Get(stName)
+	if kubeerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return st, err
+}
+
+func (c *Controller) GetIPPool() (*v1alpha1.IPPool, error) {
+	return c.ipPoolLister.Get(c.ipPoolName)
+}
+
+// UpdateIPPool applies mutate to the pool and submits the result to the
+// apiserver. Concurrent callers are serialized through updateQueue, and on
+// a resourceVersion conflict mutate is re-run against a freshly-fetched
+// copy of the pool rather than blindly resubmitting the one from an
+// earlier attempt, so two allocations racing on the same pool both apply
+// instead of the second one silently clobbering the first's reservation.
+func (c *Controller) UpdateIPPool(mutate func(*v1alpha1.IPPool) error) error {
+	req := &updateRequest{mutate: mutate, done: make(chan error, 1)}
+	c.updateQueue.Add(req)
+	return <-req.done
+}
+
+// Lock and Unlock are no-ops: like KubeClient, Controller relies on
+// resourceVersion optimistic concurrency (via applyUpdateWithRetry)
+// instead of an explicit lock.
+func (c *Controller) Lock() error   { return nil }
+func (c *Controller) Unlock() error { return nil }
+
+func (c *Controller) applyUpdateWithRetry(mutate func(*v1alpha1.IPPool) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := c.ipamClient.K8sV1alpha1().IPPools().Get(c.ipPoolName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := mutate(pool); err != nil {
+			return err
+		}
+		_, err = c.ipamClient.K8sV1alpha1().IPPools().Update(pool)
+		return err
+	})
+}
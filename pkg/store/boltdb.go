@@ -0,0 +1,349 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/domeos/k8s-ipam/pkg/api/ipam.k8s.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/api/apps/v1beta1"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	specKey            = []byte("spec")
+	reservationsBucket = []byte("reservations")
+	ipsBucket          = []byte("ips")
+	podsBucket         = []byte("pods")
+	statefulSetsBucket = []byte("statefulsets")
+)
+
+// BoltStore persists a single IPPool in a local BoltDB file, for
+// standalone or edge deployments with no Kubernetes apiserver to store a
+// CRD in. Layout is modeled on netavark's IPAM: a top-level bucket keyed by
+// pool name holds the pool's JSON-encoded spec/status under "spec", plus
+// four nested buckets. Two are kept as a secondary index -- "reservations",
+// mapping "namespace/podName" to that pod's reservations, and "ips", mapping
+// each allocated IP to its owning "namespace/podName" so ownership can be
+// looked up in O(log n) without decoding the whole pool. The other two,
+// "pods" and "statefulsets", hold whatever Pod/StatefulSet metadata SetPod/
+// SetStatefulSet were given so GetPod/GetStatefulSet can serve it back
+// without an apiserver to ask.
+type BoltStore struct {
+	Path       string
+	IPPoolName string
+
+	openOnce sync.Once
+	db       *bolt.DB
+	openErr  error
+
+	// mu serializes a GetIPPool/UpdateIPPool read-modify-write cycle.
+	// BoltDB's file lock already keeps a second process from opening the
+	// same file, but within this process there's no resourceVersion-style
+	// check to catch UpdateIPPool racing a concurrent GetIPPool, so
+	// Lock/Unlock hold mu across the whole cycle instead.
+	mu sync.Mutex
+}
+
+func (b *BoltStore) open() (*bolt.DB, error) {
+	b.openOnce.Do(func() {
+		b.db, b.openErr = bolt.Open(b.Path, 0600, nil)
+	})
+	return b.db, b.openErr
+}
+
+// Lock serializes a GetIPPool/UpdateIPPool cycle against other goroutines
+// sharing this BoltStore.
+func (b *BoltStore) Lock() error {
+	b.mu.Lock()
+	return nil
+}
+
+// Unlock releases the lock taken by Lock.
+func (b *BoltStore) Unlock() error {
+	b.mu.Unlock()
+	return nil
+}
+
+// GetIPPool reads and decodes the pool's spec/status from its bucket. A
+// BoltDB file with no bucket for IPPoolName yet -- e.g. a brand new file --
+// isn't an error; it comes back as an empty IPPool so the caller can fill
+// it in and call UpdateIPPool.
+func (b *BoltStore) GetIPPool() (*v1alpha1.IPPool, error) {
+	db, err := b.open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open boltdb at %s: %v", b.Path, err)
+	}
+
+	pool := &v1alpha1.IPPool{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.IPPoolName))
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get(specKey)
+		if raw == nil {
+			return nil
+		}
+		return json.Unmarshal(raw, pool)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pool %q from %s: %v", b.IPPoolName, b.Path, err)
+	}
+
+	pool.Name = b.IPPoolName
+	return pool, nil
+}
+
+// UpdateIPPool reads the pool's current spec/status out of its bucket,
+// applies mutate to it, and writes the result back, rebuilding the
+// "reservations" and "ips" secondary-index buckets from its current
+// DynamicReservations. BoltDB serializes db.Update callers against each
+// other, so mutate always runs against the most recently committed pool --
+// there's no resourceVersion-style conflict to retry.
+func (b *BoltStore) UpdateIPPool(mutate func(*v1alpha1.IPPool) error) error {
+	db, err := b.open()
+	if err != nil {
+		return fmt.Errorf("unable to open boltdb at %s: %v", b.Path, err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(b.IPPoolName))
+		if err != nil {
+			return err
+		}
+
+		pool := &v1alpha1.IPPool{}
+		if raw := bucket.Get(specKey); raw != nil {
+			if err := json.Unmarshal(raw, pool); err != nil {
+				return err
+			}
+		}
+		pool.Name = b.IPPoolName
+
+		if err := mutate(pool); err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(pool)
+		if err != nil {
+			return fmt.Errorf("unable to encode pool %q: %v", b.IPPoolName, err)
+		}
+		if err := bucket.Put(specKey, encoded); err != nil {
+			return err
+		}
+
+		reservations, err := bucket.CreateBucketIfNotExists(reservationsBucket)
+		if err != nil {
+			return err
+		}
+		if err := clearBucket(reservations); err != nil {
+			return err
+		}
+
+		ips, err := bucket.CreateBucketIfNotExists(ipsBucket)
+		if err != nil {
+			return err
+		}
+		if err := clearBucket(ips); err != nil {
+			return err
+		}
+
+		for namespace, nsMap := range pool.Status.DynamicReservations {
+			for podName, podReservations := range nsMap {
+				key := []byte(namespace + "/" + podName)
+
+				encoded, err := json.Marshal(podReservations)
+				if err != nil {
+					return err
+				}
+				if err := reservations.Put(key, encoded); err != nil {
+					return err
+				}
+
+				for _, reservation := range podReservations {
+					if err := ips.Put([]byte(reservation.IP.String()), key); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetPodForIP looks up ip's owner directly from the "ips" secondary index,
+// without decoding the whole pool.
+func (b *BoltStore) GetPodForIP(ip net.IP) (namespace, podName string, found bool) {
+	db, err := b.open()
+	if err != nil {
+		return "", "", false
+	}
+
+	var key string
+	_ = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.IPPoolName))
+		if bucket == nil {
+			return nil
+		}
+		ips := bucket.Bucket(ipsBucket)
+		if ips == nil {
+			return nil
+		}
+		if v := ips.Get([]byte(ip.String())); v != nil {
+			key = string(v)
+		}
+		return nil
+	})
+	if key == "" {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// podKey is the key pods and statefulsets are stored under, scoped by
+// namespace the same way the reservations/ips buckets are.
+func podKey(namespace, name string) []byte {
+	return []byte(namespace + "/" + name)
+}
+
+// SetPod records pod's metadata so a later GetPod(namespace, pod.Name) can
+// serve it back. Standalone deployments have no apiserver for GetPod to
+// query, so whatever is driving CNI ADD/DEL here -- a local agent reading
+// the container runtime's own pod sandbox metadata, most likely -- is
+// expected to call SetPod once it learns of a pod, before Allocate/Free is
+// called for it.
+func (b *BoltStore) SetPod(namespace, podName string, pod *corev1.Pod) error {
+	db, err := b.open()
+	if err != nil {
+		return fmt.Errorf("unable to open boltdb at %s: %v", b.Path, err)
+	}
+
+	encoded, err := json.Marshal(pod)
+	if err != nil {
+		return fmt.Errorf("unable to encode pod %s/%s: %v", namespace, podName, err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(b.IPPoolName))
+		if err != nil {
+			return err
+		}
+		pods, err := bucket.CreateBucketIfNotExists(podsBucket)
+		if err != nil {
+			return err
+		}
+		return pods.Put(podKey(namespace, podName), encoded)
+	})
+}
+
+// GetPod satisfies PodRetriever so a BoltStore-backed KubernetesAllocator
+// doesn't need a Kubernetes apiserver to look up a pod's annotations and
+// host IPs -- it comes back nil, nil if SetPod was never called for it.
+func (b *BoltStore) GetPod(namespace, podName string) (*corev1.Pod, error) {
+	db, err := b.open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open boltdb at %s: %v", b.Path, err)
+	}
+
+	var pod *corev1.Pod
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.IPPoolName))
+		if bucket == nil {
+			return nil
+		}
+		pods := bucket.Bucket(podsBucket)
+		if pods == nil {
+			return nil
+		}
+		raw := pods.Get(podKey(namespace, podName))
+		if raw == nil {
+			return nil
+		}
+		pod = &corev1.Pod{}
+		return json.Unmarshal(raw, pod)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pod %s/%s from %s: %v", namespace, podName, b.Path, err)
+	}
+	return pod, nil
+}
+
+// SetStatefulSet records st's metadata so a later GetStatefulSet(namespace,
+// st.Name) can serve it back, for the same reason SetPod exists.
+func (b *BoltStore) SetStatefulSet(namespace, stName string, st *v1beta1.StatefulSet) error {
+	db, err := b.open()
+	if err != nil {
+		return fmt.Errorf("unable to open boltdb at %s: %v", b.Path, err)
+	}
+
+	encoded, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("unable to encode statefulset %s/%s: %v", namespace, stName, err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(b.IPPoolName))
+		if err != nil {
+			return err
+		}
+		statefulSets, err := bucket.CreateBucketIfNotExists(statefulSetsBucket)
+		if err != nil {
+			return err
+		}
+		return statefulSets.Put(podKey(namespace, stName), encoded)
+	})
+}
+
+// GetStatefulSet satisfies PodRetriever the same way GetPod does.
+func (b *BoltStore) GetStatefulSet(namespace, stName string) (*v1beta1.StatefulSet, error) {
+	db, err := b.open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open boltdb at %s: %v", b.Path, err)
+	}
+
+	var st *v1beta1.StatefulSet
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.IPPoolName))
+		if bucket == nil {
+			return nil
+		}
+		statefulSets := bucket.Bucket(statefulSetsBucket)
+		if statefulSets == nil {
+			return nil
+		}
+		raw := statefulSets.Get(podKey(namespace, stName))
+		if raw == nil {
+			return nil
+		}
+		st = &v1beta1.StatefulSet{}
+		return json.Unmarshal(raw, st)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read statefulset %s/%s from %s: %v", namespace, stName, b.Path, err)
+	}
+	return st, nil
+}
+
+// clearBucket deletes every key in bucket, so a bucket kept as a rebuilt
+// secondary index doesn't retain entries for reservations that no longer
+// exist.
+func clearBucket(bucket *bolt.Bucket) error {
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/domeos/k8s-ipam/pkg/api/ipam.k8s.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestBoltStore(t *testing.T) *BoltStore {
+	t.Helper()
+	return &BoltStore{
+		Path:       filepath.Join(t.TempDir(), "ipam.db"),
+		IPPoolName: "test-pool",
+	}
+}
+
+func TestBoltStoreUpdateAndGetIPPool(t *testing.T) {
+	store := newTestBoltStore(t)
+
+	ip := net.ParseIP("10.1.2.3")
+	err := store.UpdateIPPool(func(pool *v1alpha1.IPPool) error {
+		pool.Status.DynamicReservations = v1alpha1.NewIPReservationMap()
+		pool.Status.DynamicReservations.Reserve("default", "pod-a", v1alpha1.IPReservation{
+			IP:          ip,
+			ContainerID: "container-a",
+			IfName:      "eth0",
+			PodRef:      v1alpha1.PodRef{Namespace: "default", PodName: "pod-a"},
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateIPPool() = %v, want nil", err)
+	}
+
+	pool, err := store.GetIPPool()
+	if err != nil {
+		t.Fatalf("GetIPPool() = _, %v, want nil error", err)
+	}
+	if pool.Name != "test-pool" {
+		t.Fatalf("GetIPPool().Name = %q, want %q", pool.Name, "test-pool")
+	}
+	reservations := pool.Status.DynamicReservations.Reservations("default", "pod-a")
+	if len(reservations) != 1 || !reservations[0].IP.Equal(ip) {
+		t.Fatalf("GetIPPool().Status.DynamicReservations reservations for pod-a = %v, want one reservation for %v", reservations, ip)
+	}
+
+	namespace, podName, found := store.GetPodForIP(ip)
+	if !found || namespace != "default" || podName != "pod-a" {
+		t.Fatalf("GetPodForIP(%v) = %q, %q, %v, want \"default\", \"pod-a\", true", ip, namespace, podName, found)
+	}
+}
+
+func TestBoltStoreUpdateIPPoolRebuildsSecondaryIndexOnEachCall(t *testing.T) {
+	store := newTestBoltStore(t)
+	ipA := net.ParseIP("10.1.2.3")
+	ipB := net.ParseIP("10.1.2.4")
+
+	reserve := func(namespace, podName string, ip net.IP) error {
+		return store.UpdateIPPool(func(pool *v1alpha1.IPPool) error {
+			if pool.Status.DynamicReservations == nil {
+				pool.Status.DynamicReservations = v1alpha1.NewIPReservationMap()
+			}
+			pool.Status.DynamicReservations.Reserve(namespace, podName, v1alpha1.IPReservation{
+				IP:     ip,
+				PodRef: v1alpha1.PodRef{Namespace: namespace, PodName: podName},
+			})
+			return nil
+		})
+	}
+
+	if err := reserve("default", "pod-a", ipA); err != nil {
+		t.Fatalf("UpdateIPPool() for pod-a = %v, want nil", err)
+	}
+	if err := reserve("default", "pod-b", ipB); err != nil {
+		t.Fatalf("UpdateIPPool() for pod-b = %v, want nil", err)
+	}
+
+	// Both reservations were made in separate UpdateIPPool calls, so the
+	// "ips" secondary index rebuilt on the second call must still hold
+	// pod-a's entry from the accumulated pool state, not just pod-b's.
+	for ip, wantPod := range map[string]string{ipA.String(): "pod-a", ipB.String(): "pod-b"} {
+		_, podName, found := store.GetPodForIP(net.ParseIP(ip))
+		if !found || podName != wantPod {
+			t.Fatalf("GetPodForIP(%v) = %q, %v, want %q, true", ip, podName, found, wantPod)
+		}
+	}
+}
+
+func TestBoltStoreSetAndGetPod(t *testing.T) {
+	store := newTestBoltStore(t)
+
+	want := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod-a",
+			Namespace:   "default",
+			Annotations: map[string]string{v1alpha1.IPAnnotation: "10.1.2.3"},
+		},
+	}
+	if err := store.SetPod("default", "pod-a", want); err != nil {
+		t.Fatalf("SetPod() = %v, want nil", err)
+	}
+
+	got, err := store.GetPod("default", "pod-a")
+	if err != nil {
+		t.Fatalf("GetPod() = _, %v, want nil error", err)
+	}
+	if got == nil || got.Annotations[v1alpha1.IPAnnotation] != "10.1.2.3" {
+		t.Fatalf("GetPod() = %v, want a pod with the %s annotation set", got, v1alpha1.IPAnnotation)
+	}
+}
+
+func TestBoltStoreGetPodForUnregisteredPodIsNilNotError(t *testing.T) {
+	store := newTestBoltStore(t)
+
+	got, err := store.GetPod("default", "no-such-pod")
+	if err != nil || got != nil {
+		t.Fatalf("GetPod() for an unregistered pod = %v, %v, want nil, nil", got, err)
+	}
+}
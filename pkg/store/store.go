@@ -0,0 +1,44 @@
+// Package store defines the storage abstraction KubernetesAllocator uses to
+// read and persist a single IPPool, so the allocator isn't hard-wired to a
+// Kubernetes apiserver. Running the IPAM on a single node or at the edge
+// shouldn't require a whole control plane just to hand out addresses.
+package store
+
+import (
+	"github.com/domeos/k8s-ipam/pkg/api/ipam.k8s.io/v1alpha1"
+)
+
+// Store persists one IPPool and provides the locking primitive needed
+// around a read-modify-write cycle, independent of whether the pool
+// actually lives in a Kubernetes CRD or a local file.
+type Store interface {
+	GetIPPool() (*v1alpha1.IPPool, error)
+
+	// UpdateIPPool fetches the current IPPool, applies mutate to it, and
+	// writes the result back. Backends that retry after a conflicting write
+	// in between (a Kubernetes resourceVersion mismatch, most commonly)
+	// re-fetch and call mutate again against that fresh copy rather than
+	// resubmitting the stale one -- mutate must be safe to call more than
+	// once for the same UpdateIPPool call, and should operate only on the
+	// *v1alpha1.IPPool passed to it, not any earlier snapshot the caller
+	// may have captured via GetIPPool.
+	UpdateIPPool(mutate func(*v1alpha1.IPPool) error) error
+
+	// Lock and Unlock bracket a GetIPPool/UpdateIPPool read-modify-write
+	// cycle for backends that have no equivalent of Kubernetes'
+	// resourceVersion optimistic-concurrency check. A backend that already
+	// detects conflicting writes some other way (like the Kubernetes
+	// backends, where the apiserver rejects a stale resourceVersion and
+	// UpdateIPPool either retries it or returns the conflict error) may
+	// implement these as no-ops.
+	Lock() error
+	Unlock() error
+}
+
+// Backend selects which Store implementation to use, set via config.
+type Backend string
+
+const (
+	BackendKubernetes Backend = "kubernetes"
+	BackendBoltDB     Backend = "boltdb"
+)